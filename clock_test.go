@@ -0,0 +1,69 @@
+package icingadb_ha_lib
+
+import (
+	"sync"
+	"time"
+)
+
+// manualClock is a Clock whose time only moves when Advance is called, so tests can drive
+// HA's state machine through takeover/lose/regain scenarios deterministically and in
+// microseconds instead of waiting on real timeouts.
+type manualClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*manualTicker
+}
+
+func newManualClock(start time.Time) *manualClock {
+	return &manualClock{now: start}
+}
+
+func (c *manualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+// Advance moves the clock forward by d.
+func (c *manualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+}
+
+func (c *manualClock) NewTicker(time.Duration) Ticker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := &manualTicker{c: make(chan time.Time, 1)}
+	c.tickers = append(c.tickers, t)
+	return t
+}
+
+// Tick delivers the current time on every ticker this clock has handed out, so a test can make
+// run()'s loop observe a tick after Advance instead of waiting on C() in real time.
+func (c *manualClock) Tick() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, t := range c.tickers {
+		select {
+		case t.c <- c.now:
+		default:
+		}
+	}
+}
+
+// manualTicker never fires on its own; tests that need run()'s loop to observe a tick
+// advance the clock and then call manualClock.Tick() rather than waiting on C() in real time.
+type manualTicker struct {
+	c chan time.Time
+}
+
+func (t *manualTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *manualTicker) Stop() {}
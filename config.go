@@ -0,0 +1,87 @@
+package icingadb_ha_lib
+
+import (
+	"fmt"
+	"time"
+)
+
+// Config configures the HA subsystem. Logging is deliberately not part of this struct: NewHA
+// takes an already-constructed *logging.Logging, so the level/output/interval knobs operators
+// expect belong to whatever config struct the caller used to build that *logging.Logging, not
+// to this one.
+type Config struct {
+	Metrics MetricsConfig
+	HA      HAConfig
+}
+
+// MetricsConfig configures whether and where HA exposes Prometheus metrics.
+type MetricsConfig struct {
+	// Enabled turns on the /metrics HTTP endpoint.
+	Enabled bool
+	// Host is the address to listen on, e.g. "0.0.0.0".
+	Host string
+	// Port is the port to listen on.
+	Port uint16
+}
+
+// HAConfig holds HA's timing knobs. Its defaults match what used to be hardcoded; tests can
+// shrink every duration to drive the state machine through takeover/lose/regain in milliseconds.
+type HAConfig struct {
+	// Tick is how often the state machine evaluates and acts.
+	Tick time.Duration
+	// Icinga2Timeout is how long Icinga2HeartBeat may go uncalled before Icinga 2 is considered not running.
+	Icinga2Timeout time.Duration
+	// PeerHeartbeatTimeout is how stale a peer's lease must be before we may take over from it.
+	PeerHeartbeatTimeout time.Duration
+	// TakeoverConfirmDelay is how long we stay in TakeoverNoSync before declaring TakeoverSync.
+	TakeoverConfirmDelay time.Duration
+	// CriticalDrainGrace is how long after the last critical operation ended we wait before ceasing.
+	CriticalDrainGrace time.Duration
+	// InstanceGCAge is how stale an icingadb_instance row's heartbeat must be before it's garbage collected.
+	InstanceGCAge time.Duration
+	// InstanceGCInterval is how often the icingadb_instance GC runs.
+	InstanceGCInterval time.Duration
+}
+
+// DefaultHAConfig returns HAConfig's defaults, matching HA's previously hardcoded timings.
+func DefaultHAConfig() HAConfig {
+	return HAConfig{
+		Tick:                 time.Second,
+		Icinga2Timeout:       15 * time.Second,
+		PeerHeartbeatTimeout: 10 * time.Second,
+		TakeoverConfirmDelay: 5 * time.Second,
+		CriticalDrainGrace:   5 * time.Second,
+		InstanceGCAge:        30 * time.Second,
+		InstanceGCInterval:   5 * time.Minute,
+	}
+}
+
+// Validate checks that HAConfig's durations are positive and consistent with each other.
+func (c HAConfig) Validate() error {
+	durations := []struct {
+		name string
+		d    time.Duration
+	}{
+		{"Tick", c.Tick},
+		{"Icinga2Timeout", c.Icinga2Timeout},
+		{"PeerHeartbeatTimeout", c.PeerHeartbeatTimeout},
+		{"TakeoverConfirmDelay", c.TakeoverConfirmDelay},
+		{"CriticalDrainGrace", c.CriticalDrainGrace},
+		{"InstanceGCAge", c.InstanceGCAge},
+		{"InstanceGCInterval", c.InstanceGCInterval},
+	}
+	for _, dur := range durations {
+		if dur.d <= 0 {
+			return fmt.Errorf("%s (%s) must be positive", dur.name, dur.d)
+		}
+	}
+
+	if c.PeerHeartbeatTimeout <= c.Tick*2 {
+		return fmt.Errorf(
+			"PeerHeartbeatTimeout (%s) must be greater than Tick*2 (%s)",
+			c.PeerHeartbeatTimeout, c.Tick*2,
+		)
+	}
+
+	return nil
+}
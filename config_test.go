@@ -0,0 +1,52 @@
+package icingadb_ha_lib
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHAConfigValidate(t *testing.T) {
+	valid := DefaultHAConfig()
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("Validate() on defaults = %v, want nil", err)
+	}
+
+	for _, field := range []string{
+		"Tick", "Icinga2Timeout", "PeerHeartbeatTimeout", "TakeoverConfirmDelay",
+		"CriticalDrainGrace", "InstanceGCAge", "InstanceGCInterval",
+	} {
+		for _, zeroOrNegative := range []time.Duration{0, -time.Second} {
+			cfg := DefaultHAConfig()
+			switch field {
+			case "Tick":
+				cfg.Tick = zeroOrNegative
+			case "Icinga2Timeout":
+				cfg.Icinga2Timeout = zeroOrNegative
+			case "PeerHeartbeatTimeout":
+				cfg.PeerHeartbeatTimeout = zeroOrNegative
+			case "TakeoverConfirmDelay":
+				cfg.TakeoverConfirmDelay = zeroOrNegative
+			case "CriticalDrainGrace":
+				cfg.CriticalDrainGrace = zeroOrNegative
+			case "InstanceGCAge":
+				cfg.InstanceGCAge = zeroOrNegative
+			case "InstanceGCInterval":
+				cfg.InstanceGCInterval = zeroOrNegative
+			}
+
+			if err := cfg.Validate(); err == nil {
+				t.Fatalf("Validate() with %s=%s = nil, want an error", field, zeroOrNegative)
+			}
+		}
+	}
+}
+
+func TestHAConfigValidateRejectsLowPeerHeartbeatTimeout(t *testing.T) {
+	cfg := DefaultHAConfig()
+	cfg.Tick = time.Second
+	cfg.PeerHeartbeatTimeout = cfg.Tick * 2
+
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("Validate() with PeerHeartbeatTimeout == Tick*2 = nil, want an error")
+	}
+}
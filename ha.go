@@ -1,11 +1,19 @@
 package icingadb_ha_lib
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
+	"errors"
+	"fmt"
 	"git.icinga.com/icingadb-connection"
+	"git.icinga.com/icingadb-ha-lib/metrics"
+	"git.icinga.com/logging"
 	"github.com/go-redis/redis"
 	"github.com/google/uuid"
-	log "github.com/sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -43,6 +51,22 @@ const doTakeover responsibilityAction = 2
 // ceaseOperation says that we're going to release our responsibility.
 const ceaseOperation responsibilityAction = 3
 
+// ErrLeaseFenced is returned by RunCriticalOperation if our lease epoch changed while op was
+// running, meaning another instance has since taken over and our result may be stale.
+var ErrLeaseFenced = errors.New("icingadb_ha_lib: lease epoch changed during critical operation")
+
+// dbWrapper is the subset of *icingadb_connection.DBWrapper's API that run() and its helpers
+// need. It's declared here, narrower than the concrete type Run() is handed, purely so tests
+// can drive the takeover/cease/renew state machine against a fake backed by an in-memory
+// icingadb_instance table instead of a real database.
+type dbWrapper interface {
+	SqlTransaction(fatal, retry bool, f func(tx *sql.Tx) error) error
+	SqlTransactionQuiet(fatal, retry bool, f func(tx *sql.Tx) error) error
+	SqlExec(tx *sql.Tx, label, query string, args ...interface{}) (sql.Result, error)
+	SqlExecQuiet(tx *sql.Tx, label, query string, args ...interface{}) (sql.Result, error)
+	SqlFetchAllQuiet(tx *sql.Tx, label, query string, args ...interface{}) ([][]interface{}, error)
+}
+
 type HA struct {
 	ourUUID      uuid.UUID
 	icinga2MTime int64
@@ -54,18 +78,104 @@ type HA struct {
 	runningCriticalOperations uint64
 	// lastCriticalOperationEnd tells when the last critical operation finished.
 	lastCriticalOperationEnd int64
+	// leaseEpoch is the fencing epoch of our current lease, or 0 if we don't hold one.
+	leaseEpoch int64
+	// dbw and env are populated once run() has received its environment, so that
+	// Shutdown() can perform its own clean-up queries without being handed them again.
+	dbw atomic.Value
+	env atomic.Value
+	// done is closed once run() has returned, so Shutdown() can tell it already exited.
+	done chan struct{}
+	// mu guards done/stopRequested/stopClosed (which Run() (re)creates and Shutdown() reads
+	// and closes from a different goroutine) and metrics/registeredReg/metricsServing (which
+	// Run() (re)sets and RunCriticalOperation and others read from whatever goroutine calls
+	// them).
+	mu sync.Mutex
+	// stopRequested is closed by Shutdown once run()'s loop may actually exit, i.e. once
+	// any in-flight critical operation has drained.
+	stopRequested chan struct{}
+	// stopClosed guards against closing stopRequested twice.
+	stopClosed bool
+	// shuttingDown is set once Shutdown has been called, so run()'s stop handling parks
+	// instead of running ceaseOperation and reverting the stop state Shutdown installed.
+	shuttingDown uint32
+	// logger is our "ha" child logger.
+	logger *zap.SugaredLogger
+	// cfg holds our configuration, most notably our timing knobs.
+	cfg *Config
+	// metrics are our Prometheus collectors. registeredReg is the registry they were last
+	// registered on, so a Run() call reusing that same registry doesn't re-register (and
+	// panic on duplicate collector names), while a Run() call passed a genuinely different
+	// registry still gets its own collectors.
+	metrics       *metrics.Collectors
+	registeredReg *prometheus.Registry
+	// metricsServing is true while a metrics.ServeHTTP goroutine from a previous (or the
+	// current) Run() call is still bound to cfg.Metrics.Host:Port, so a Run() restarted on a
+	// ctx that isn't done yet doesn't start a second listener and fail with "address already
+	// in use".
+	metricsServing bool
+	// clock is what we tell the time by; tests can substitute a fake one.
+	clock Clock
 }
 
-// RunCriticalOperation runs op and manages HA#runningCriticalOperations if we're responsible.
-func (h *HA) RunCriticalOperation(op func() error) error {
+// NewHA creates a new HA, logging through the "ha" child logger of logs. logs is expected to
+// already be configured (level, output, flush interval) by its caller; this package has no
+// logging config of its own to wire in. If cfg.HA is the zero value, it defaults to
+// DefaultHAConfig(); otherwise it's validated, and NewHA fails if it isn't sane.
+func NewHA(cfg *Config, logs *logging.Logging) (*HA, error) {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+
+	if cfg.HA == (HAConfig{}) {
+		cfg.HA = DefaultHAConfig()
+	}
+
+	if errValidate := cfg.HA.Validate(); errValidate != nil {
+		return nil, errValidate
+	}
+
+	return &HA{
+		cfg:           cfg,
+		logger:        logs.GetChildLogger("ha"),
+		clock:         realClock{},
+		stopRequested: make(chan struct{}),
+	}, nil
+}
+
+// RunCriticalOperation runs op, passing it the epoch of the lease we're holding, and manages
+// HA#runningCriticalOperations if we're responsible. If our lease epoch changed while op was
+// running, i.e. fencing kicked in underneath it, ErrLeaseFenced is returned even if op succeeded,
+// so the caller can treat its result as stale.
+func (h *HA) RunCriticalOperation(ctx context.Context, op func(epoch int64) error) error {
 	switch h.getResponsibility() {
 	case TakeoverSync, stop:
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		epoch := h.LeaseEpoch()
+
 		atomic.AddUint64(&h.runningCriticalOperations, 1)
+		if m := h.loadMetrics(); m != nil {
+			m.RunningCriticalOperations.Set(float64(atomic.LoadUint64(&h.runningCriticalOperations)))
+		}
 
-		err := op()
+		start := h.clock.Now()
+		err := op(epoch)
 
-		atomic.StoreInt64(&h.lastCriticalOperationEnd, time.Now().Unix())
+		atomic.StoreInt64(&h.lastCriticalOperationEnd, h.clock.Now().Unix())
 		atomic.AddUint64(&h.runningCriticalOperations, ^uint64(0))
+		if m := h.loadMetrics(); m != nil {
+			m.RunningCriticalOperations.Set(float64(atomic.LoadUint64(&h.runningCriticalOperations)))
+			m.CriticalOperationDuration.Observe(h.clock.Now().Sub(start).Seconds())
+		}
+
+		if err == nil && h.LeaseEpoch() != epoch {
+			return ErrLeaseFenced
+		}
 
 		return err
 	}
@@ -73,48 +183,179 @@ func (h *HA) RunCriticalOperation(op func() error) error {
 	return nil
 }
 
+// LeaseEpoch returns the fencing epoch of our current lease, or 0 if we don't hold one.
+func (h *HA) LeaseEpoch() int64 {
+	return atomic.LoadInt64(&h.leaseEpoch)
+}
+
 func (h *HA) Icinga2HeartBeat() {
-	atomic.StoreInt64(&h.icinga2MTime, time.Now().Unix())
+	atomic.StoreInt64(&h.icinga2MTime, h.clock.Now().Unix())
 }
 
 func (h *HA) IsResponsible() bool {
 	return h.getResponsibility() == TakeoverSync
 }
 
-func (h *HA) Run(rdb *redis.Client, dbw *icingadb_connection.DBWrapper, chEnv chan *icingadb_connection.Environment, chErr chan error) {
-	go cleanUpInstancesAsync(dbw, chErr)
+// Run runs h's state machine until ctx is done or it encounters a fatal error, reported on
+// chErr. A supervisor may call Run again after it returns, e.g. to retry following a transient
+// error on chErr, but must pass a ctx that is actually done by then: Run doesn't cancel the ctx
+// of a previous call, so the metrics HTTP server (if enabled) started under it keeps running,
+// and Run skips starting another one on top of it until that one has stopped.
+func (h *HA) Run(ctx context.Context, rdb *redis.Client, dbw dbWrapper, chEnv chan *icingadb_connection.Environment, chErr chan error, reg *prometheus.Registry) {
+	done := make(chan struct{})
+	defer close(done)
+
+	// A prior Shutdown() may have closed stopRequested and left shuttingDown set; reset both
+	// so a supervisor restarting Run() (e.g. after a transient error on chErr) gets a fresh
+	// HA rather than one that immediately exits as if Shutdown had just been called again.
+	h.mu.Lock()
+	h.done = done
+	h.stopRequested = make(chan struct{})
+	h.stopClosed = false
+	if h.metrics == nil || h.registeredReg != reg {
+		h.metrics = metrics.NewCollectors(reg)
+		h.registeredReg = reg
+	}
+	startMetricsServer := h.cfg.Metrics.Enabled && !h.metricsServing
+	if startMetricsServer {
+		h.metricsServing = true
+	}
+	h.mu.Unlock()
+	atomic.StoreUint32(&h.shuttingDown, 0)
+
+	if startMetricsServer {
+		go func() {
+			defer func() {
+				h.mu.Lock()
+				h.metricsServing = false
+				h.mu.Unlock()
+			}()
+
+			addr := fmt.Sprintf("%s:%d", h.cfg.Metrics.Host, h.cfg.Metrics.Port)
+			if errServe := metrics.ServeHTTP(ctx, addr, reg); errServe != nil {
+				chErr <- errServe
+			}
+		}()
+	}
+
+	go cleanUpInstancesAsync(ctx, dbw, chErr, h.logger, h.clock, h.cfg.HA.InstanceGCAge, h.cfg.HA.InstanceGCInterval)
 
-	if errRun := h.run(rdb, dbw, chEnv); errRun != nil {
+	if errRun := h.run(ctx, rdb, dbw, chEnv); errRun != nil {
 		chErr <- errRun
 		return
 	}
 }
 
-// cleanUpInstancesAsync cleans up icingadb_instance periodically.
-func cleanUpInstancesAsync(dbw *icingadb_connection.DBWrapper, chErr chan error) {
-	every5m := time.NewTicker(5 * time.Minute)
-	defer every5m.Stop()
+// Shutdown transitions h into the stop state, waits for any critical operation that is
+// still running to finish, plus CriticalDrainGrace (bounded by ctx, and matching the grace
+// period run()'s own stop handling requires before it would consider itself drained), then
+// stops run()'s loop itself, hands our responsibility back by UPDATEing
+// icingadb_instance.responsible='n', moves h to notReadyForTakeover so RunCriticalOperation
+// refuses any operation started after this point, and only then returns. It is safe to call
+// Shutdown before run() ever received an environment; in that case it returns as soon as run()
+// itself has returned.
+func (h *HA) Shutdown(ctx context.Context) error {
+	atomic.StoreUint32(&h.shuttingDown, 1)
+	h.setResponsibility(stop)
 
-	for {
-		<-every5m.C
+	done := h.doneCh()
+
+	every := h.clock.NewTicker(h.cfg.HA.Tick)
+	defer every.Stop()
 
-		if errCI := cleanUpInstances(dbw); errCI != nil {
-			chErr <- errCI
+	for !h.criticalOperationsDrained() {
+		select {
+		case <-done:
+			h.finishShutdown()
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-every.C():
 		}
 	}
+
+	h.requestStop()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	dbw, _ := h.dbw.Load().(dbWrapper)
+	if dbw == nil {
+		// run() never got far enough to register us, nothing to hand back.
+		h.finishShutdown()
+		return nil
+	}
+
+	errTx := dbw.SqlTransaction(true, true, func(tx *sql.Tx) error {
+		_, errExec := dbw.SqlExec(
+			tx,
+			"update icingadb_instance by id",
+			`UPDATE icingadb_instance SET responsible=? WHERE id = ?`,
+			"n",
+			h.ourUUID[:],
+		)
+
+		return errExec
+	})
+	if errTx != nil {
+		return errTx
+	}
+
+	h.finishShutdown()
+	return nil
 }
 
-// cleanUpInstances cleans up icingadb_instance periodically.
-func cleanUpInstances(dbw *icingadb_connection.DBWrapper) error {
+// finishShutdown moves h to notReadyForTakeover and drops the lease epoch once Shutdown knows
+// run() has returned and (if it ever got that far) responsibility has been handed back: stop is
+// one of the two responsibility values RunCriticalOperation still permits execution under, so
+// without this a caller invoking RunCriticalOperation after Shutdown has returned would get a
+// clean, seemingly-fenced-but-not success on an instance that already told the world it isn't
+// responsible.
+func (h *HA) finishShutdown() {
+	atomic.StoreInt64(&h.leaseEpoch, 0)
+	h.setResponsibility(notReadyForTakeover)
+}
 
-	log.WithFields(log.Fields{"context": "HA"}).Info("Cleaning up icingadb_instance")
+// cleanUpInstancesAsync cleans up icingadb_instance every interval.
+func cleanUpInstancesAsync(
+	ctx context.Context,
+	dbw dbWrapper,
+	chErr chan error,
+	logger *zap.SugaredLogger,
+	clock Clock,
+	age time.Duration,
+	interval time.Duration,
+) {
+	everyInterval := clock.NewTicker(interval)
+	defer everyInterval.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-everyInterval.C():
+			if errCI := cleanUpInstances(dbw, logger, clock, age); errCI != nil {
+				chErr <- errCI
+			}
+		}
+	}
+}
+
+// cleanUpInstances deletes icingadb_instance rows whose heartbeat is older than age.
+func cleanUpInstances(dbw dbWrapper, logger *zap.SugaredLogger, clock Clock, age time.Duration) error {
+
+	logger.Info("Cleaning up icingadb_instance")
 
 	errTx := dbw.SqlTransaction(true, true, func(tx *sql.Tx) error {
 		_, errExec := dbw.SqlExec(
 			tx,
 			"delete from icingadb_instance by heartbeat",
-			`DELETE FROM icingadb_instance WHERE ? - heartbeat >= 30`,
-			time.Now().Unix(),
+			`DELETE FROM icingadb_instance WHERE ? - heartbeat >= ?`,
+			clock.Now().Unix(),
+			int64(age.Seconds()),
 		)
 
 		return errExec
@@ -122,96 +363,67 @@ func cleanUpInstances(dbw *icingadb_connection.DBWrapper) error {
 	return errTx
 }
 
-func (h *HA) run(rdb *redis.Client, dbw *icingadb_connection.DBWrapper, chEnv chan *icingadb_connection.Environment) error {
-	log.WithFields(log.Fields{"context": "HA"}).Info("Waiting for Icinga 2 to tell us its environment")
+func (h *HA) run(ctx context.Context, rdb *redis.Client, dbw dbWrapper, chEnv chan *icingadb_connection.Environment) error {
+	h.logger.Info("Waiting for Icinga 2 to tell us its environment")
+
+	h.dbw.Store(dbw)
+
+	stopRequested := h.stopCh()
 
 	var env *icingadb_connection.Environment = nil
 	var hasEnv bool
 
-	env, hasEnv = <-chEnv
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-stopRequested:
+		return nil
+	case env, hasEnv = <-chEnv:
+	}
 	if !hasEnv {
 		return nil
 	}
 
+	h.env.Store(env)
+
 	var errNR error
 	if h.ourUUID, errNR = uuid.NewRandom(); errNR != nil {
 		return errNR
 	}
 
-	log.WithFields(log.Fields{
-		"context": "HA",
-		"uuid":    h.ourUUID.String(),
-		"env":     env.Name,
-	}).Info("Received environment from Icinga 2")
+	h.logger.Infow("Received environment from Icinga 2", "uuid", h.ourUUID.String(), "env", env.Name)
 
-	everySecond := time.NewTicker(time.Second)
-	defer everySecond.Stop()
+	everyTick := h.clock.NewTicker(h.cfg.HA.Tick)
+	defer everyTick.Stop()
 
 	var nextAction responsibilityAction
-	var theirUUID uuid.UUID
 
 	// Even if Icinga 2 is offline now, Redis may be filled
 	h.Icinga2HeartBeat()
 
 	for {
-		switch h.getResponsibility() {
-		case readyForTakeover:
-			if !h.icinga2IsAlive() {
-				log.WithFields(log.Fields{
-					"context": "HA",
-					"uuid":    h.ourUUID.String(),
-					"env":     env.Name,
-				}).Warn("Icinga 2 detected as not running, stopping.")
-
-				h.setResponsibility(notReadyForTakeover)
-				continue
-			}
-
-			nextAction = tryTakeover
-		case TakeoverNoSync:
-			if !h.icinga2IsAlive() {
-				log.WithFields(log.Fields{
-					"context": "HA",
-					"uuid":    h.ourUUID.String(),
-					"env":     env.Name,
-				}).Warn("Icinga 2 detected as not running, stopping.")
-
-				h.setResponsibility(stop)
-				continue
-			}
+		if h.checkIcinga2Liveness(env) {
+			continue
+		}
 
+		switch h.getResponsibility() {
+		case readyForTakeover, TakeoverNoSync:
 			nextAction = tryTakeover
 		case TakeoverSync:
-			if !h.icinga2IsAlive() {
-				log.WithFields(log.Fields{
-					"context": "HA",
-					"uuid":    h.ourUUID.String(),
-					"env":     env.Name,
-				}).Warn("Icinga 2 detected as not running, stopping.")
-
-				h.setResponsibility(stop)
-				continue
-			}
-
 			nextAction = doTakeover
 		case stop:
-			if atomic.LoadUint64(&h.runningCriticalOperations) == 0 && time.Now().Unix()-atomic.LoadInt64(&h.lastCriticalOperationEnd) >= 5 {
-				nextAction = ceaseOperation
-			} else {
+			switch {
+			case !h.criticalOperationsDrained():
 				nextAction = doTakeover
+			case atomic.LoadUint32(&h.shuttingDown) == 1:
+				// Shutdown() installed this stop and is waiting for us to drain before it
+				// does its own handover; don't let ceaseOperation revert that out from
+				// under it. run() exits once Shutdown() calls h.requestStop().
+				nextAction = noAction
+			default:
+				nextAction = ceaseOperation
 			}
 		case notReadyForTakeover:
-			if h.icinga2IsAlive() {
-				log.WithFields(log.Fields{
-					"context": "HA",
-					"uuid":    h.ourUUID.String(),
-					"env":     env.Name,
-				}).Info("Icinga 2 detected as running again.")
-
-				h.setResponsibility(readyForTakeover)
-				continue
-			}
-
 			nextAction = noAction
 		}
 
@@ -220,6 +432,13 @@ func (h *HA) run(rdb *redis.Client, dbw *icingadb_connection.DBWrapper, chEnv ch
 			break
 		case tryTakeover, doTakeover:
 			var justTakenOver bool
+			var leaseFenced bool
+
+			if m := h.loadMetrics(); m != nil && atomic.LoadInt64(&h.leaseEpoch) == 0 {
+				m.TakeoverAttempts.Inc()
+			}
+
+			now := h.clock.Now().Unix()
 
 			errTx := dbw.SqlTransactionQuiet(true, true, func(tx *sql.Tx) error {
 				{
@@ -239,7 +458,7 @@ func (h *HA) run(rdb *redis.Client, dbw *icingadb_connection.DBWrapper, chEnv ch
 							"update icingadb_instance by id",
 							`UPDATE icingadb_instance SET environment_id=?, heartbeat=? WHERE id = ?`,
 							env.ID,
-							time.Now().Unix(),
+							now,
 							h.ourUUID[:],
 						)
 						if errExec != nil {
@@ -249,11 +468,13 @@ func (h *HA) run(rdb *redis.Client, dbw *icingadb_connection.DBWrapper, chEnv ch
 						_, errExec := dbw.SqlExecQuiet(
 							tx,
 							"insert into icingadb_instance",
-							`INSERT INTO icingadb_instance(id, environment_id, heartbeat, responsible) VALUES (?, ?, ?, ?)`,
+							`INSERT INTO icingadb_instance(id, environment_id, heartbeat, responsible, lease_epoch, lease_expires_at) VALUES (?, ?, ?, ?, ?, ?)`,
 							h.ourUUID[:],
 							env.ID,
-							time.Now().Unix(),
+							now,
 							"n",
+							0,
+							0,
 						)
 						if errExec != nil {
 							return errExec
@@ -263,109 +484,145 @@ func (h *HA) run(rdb *redis.Client, dbw *icingadb_connection.DBWrapper, chEnv ch
 
 				justTakenOver = false
 
+				if ourEpoch := atomic.LoadInt64(&h.leaseEpoch); ourEpoch > 0 {
+					// We believe we're already the leader: renew under fencing. Another
+					// instance taking over gives its own row a newer epoch, so if any row for
+					// this environment holds an epoch above ours, or the renewal affects zero
+					// rows, we must stop acting as leader right away.
+					rows, errFA := dbw.SqlFetchAllQuiet(
+						tx,
+						"select from icingadb_instance by environment_id for update",
+						`SELECT id, responsible, lease_epoch, lease_expires_at FROM icingadb_instance WHERE environment_id = ? FOR UPDATE`,
+						env.ID,
+					)
+					if errFA != nil {
+						return errFA
+					}
+
+					for _, row := range rows {
+						if epoch, _ := row[2].(int64); epoch > ourEpoch {
+							atomic.StoreInt64(&h.leaseEpoch, 0)
+							leaseFenced = true
+							return nil
+						}
+					}
+
+					res, errExec := dbw.SqlExecQuiet(
+						tx,
+						"renew icingadb_instance lease by id, lease_epoch",
+						`UPDATE icingadb_instance SET lease_expires_at=? WHERE id = ? AND lease_epoch = ?`,
+						now+int64(h.cfg.HA.PeerHeartbeatTimeout.Seconds()),
+						h.ourUUID[:],
+						ourEpoch,
+					)
+					if errExec != nil {
+						return errExec
+					}
+
+					affected, errRA := res.RowsAffected()
+					if errRA != nil {
+						return errRA
+					}
+
+					if affected == 1 {
+						justTakenOver = true
+						return nil
+					}
+
+					atomic.StoreInt64(&h.leaseEpoch, 0)
+					leaseFenced = true
+					return nil
+				}
+
+				// Lock every row for this environment before deciding whether to take over:
+				// a plain "NOT EXISTS" conditional UPDATE only reads a snapshot, so two
+				// candidates in separate transactions can both see no live leader and both
+				// commit. FOR UPDATE forces the second candidate's transaction to block here
+				// until the first one commits or rolls back, so it then sees the up-to-date
+				// row instead of racing it.
 				rows, errFA := dbw.SqlFetchAllQuiet(
 					tx,
-					"select from icingadb_instance by environment_id, responsible",
-					`SELECT id, heartbeat FROM icingadb_instance WHERE environment_id = ? AND responsible = ?`,
+					"select from icingadb_instance by environment_id for update",
+					`SELECT id, responsible, lease_epoch, lease_expires_at FROM icingadb_instance WHERE environment_id = ? FOR UPDATE`,
 					env.ID,
-					"y",
 				)
 				if errFA != nil {
 					return errFA
 				}
 
-				if len(rows) > 0 {
-					copy(theirUUID[:], rows[0][0].([]byte))
-
-					if theirUUID == h.ourUUID {
-						justTakenOver = true
-					} else if time.Now().Unix()-rows[0][1].(int64) >= 10 {
-						{
-							_, errExec := dbw.SqlExecQuiet(
-								tx,
-								"update icingadb_instance by environment_id",
-								`UPDATE icingadb_instance SET responsible=? WHERE environment_id = ?`,
-								"n",
-								env.ID,
-							)
-							if errExec != nil {
-								return errExec
-							}
-						}
+				var maxEpoch int64
+				liveLeader := false
 
-						_, errExec := dbw.SqlExecQuiet(
-							tx,
-							"update icingadb_instance by id",
-							`UPDATE icingadb_instance SET responsible=? WHERE id = ?`,
-							"y",
-							h.ourUUID[:],
-						)
-						if errExec != nil {
-							return errExec
-						}
+				for _, row := range rows {
+					id, _ := row[0].([]byte)
+					responsible, _ := row[1].(string)
+					epoch, _ := row[2].(int64)
+					expiresAt, _ := row[3].(int64)
 
-						justTakenOver = true
+					if epoch > maxEpoch {
+						maxEpoch = epoch
 					}
-				} else {
-					_, errExec := dbw.SqlExecQuiet(
-						tx,
-						"update icingadb_instance by id",
-						`UPDATE icingadb_instance SET responsible=? WHERE id = ?`,
-						"y",
-						h.ourUUID[:],
-					)
-					if errExec != nil {
-						return errExec
+
+					if responsible == "y" && expiresAt >= now && !bytes.Equal(id, h.ourUUID[:]) {
+						liveLeader = true
 					}
+				}
+
+				if liveLeader {
+					return nil
+				}
+
+				newEpoch := maxEpoch + 1
 
-					justTakenOver = true
+				_, errExec := dbw.SqlExecQuiet(
+					tx,
+					"take over icingadb_instance lease by id",
+					`UPDATE icingadb_instance SET responsible=?, lease_epoch=?, lease_expires_at=? WHERE id = ?`,
+					"y",
+					newEpoch,
+					now+int64(h.cfg.HA.PeerHeartbeatTimeout.Seconds()),
+					h.ourUUID[:],
+				)
+				if errExec != nil {
+					return errExec
 				}
 
+				atomic.StoreInt64(&h.leaseEpoch, newEpoch)
+				justTakenOver = true
+
 				return nil
 			})
 			if errTx != nil {
 				return errTx
 			}
 
-			if justTakenOver && h.getResponsibility() != stop {
-				if h.responsibleSince == (time.Time{}) {
-					h.responsibleSince = time.Now()
-					h.setResponsibility(TakeoverNoSync)
-				} else {
-					responsibleFor := time.Now().Sub(h.responsibleSince).Seconds()
-
-					if responsibleFor >= 5.0 {
-						if h.setResponsibility(TakeoverSync) == TakeoverNoSync {
-							log.WithFields(log.Fields{
-								"context":    "HA",
-								"env":        env.Name,
-								"their_uuid": theirUUID.String(),
-							}).Info("Taking over")
-						}
+			if leaseFenced {
+				h.setResponsibility(notReadyForTakeover)
+				h.recordResponsibility(env)
+				break
+			}
 
-						if _, errRP := rdb.Publish("icingadb:wakeup", h.ourUUID.String()).Result(); errRP != nil {
-							return errRP
-						}
+			if justTakenOver && h.getResponsibility() != stop {
+				if h.confirmTakeover(env) {
+					if _, errRP := rdb.Publish("icingadb:wakeup", h.ourUUID.String()).Result(); errRP != nil {
+						return errRP
 					}
 				}
 			}
 
 			if !justTakenOver {
-				log.WithFields(log.Fields{
-					"context":    "HA",
-					"env":        env.Name,
-					"their_uuid": theirUUID.String(),
-				}).Info("Other instance is responsible")
+				h.logger.Infow("Other instance is responsible", "env", env.Name)
 			}
 		case ceaseOperation:
 			errTx := dbw.SqlTransactionQuiet(true, true, func(tx *sql.Tx) error {
 				rows, errFA := dbw.SqlFetchAllQuiet(
 					tx,
 					"select from icingadb_instance by environment_id, responsible, heartbeat",
-					`SELECT 1 FROM icingadb_instance WHERE environment_id = ? AND responsible = ? AND ? - heartbeat < 10`,
+					`SELECT 1 FROM icingadb_instance WHERE environment_id = ? AND responsible = ? AND ? - heartbeat < ?`,
 					env.ID,
 					"n",
-					time.Now().Unix(),
+					h.clock.Now().Unix(),
+					int64(h.cfg.HA.PeerHeartbeatTimeout.Seconds()),
 				)
 				if errFA != nil {
 					return errFA
@@ -375,8 +632,9 @@ func (h *HA) run(rdb *redis.Client, dbw *icingadb_connection.DBWrapper, chEnv ch
 					_, errExec := dbw.SqlExecQuiet(
 						tx,
 						"update icingadb_instance",
-						`UPDATE icingadb_instance SET responsible=? WHERE id = ?`,
+						`UPDATE icingadb_instance SET responsible=?, lease_expires_at=? WHERE id = ?`,
 						"n",
+						0,
 						h.ourUUID[:],
 					)
 
@@ -389,23 +647,32 @@ func (h *HA) run(rdb *redis.Client, dbw *icingadb_connection.DBWrapper, chEnv ch
 				return errTx
 			}
 
-			log.WithFields(log.Fields{
-				"context": "HA",
-				"env":     env.Name,
-			}).Info("Other instance is responsible. Ceasing operations.")
+			atomic.StoreInt64(&h.leaseEpoch, 0)
+
+			h.logger.Infow("Other instance is responsible. Ceasing operations.", "env", env.Name)
+			if m := h.loadMetrics(); m != nil {
+				m.CeaseOperations.Inc()
+			}
 
 			h.responsibleSince = time.Time{}
 			h.setResponsibility(notReadyForTakeover)
+			h.recordResponsibility(env)
 		}
 
 		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-stopRequested:
+			return nil
 		case env, hasEnv = <-chEnv:
 			if !hasEnv {
 				return nil
 			}
 
-			<-everySecond.C
-		case <-everySecond.C:
+			h.env.Store(env)
+
+			<-everyTick.C()
+		case <-everyTick.C():
 			break
 		}
 	}
@@ -413,7 +680,129 @@ func (h *HA) run(rdb *redis.Client, dbw *icingadb_connection.DBWrapper, chEnv ch
 
 // icinga2IsAlive returns whether Icinga 2 seems to be running.
 func (h *HA) icinga2IsAlive() bool {
-	return time.Now().Unix()-atomic.LoadInt64(&h.icinga2MTime) < 15
+	return h.clock.Now().Unix()-atomic.LoadInt64(&h.icinga2MTime) < int64(h.cfg.HA.Icinga2Timeout.Seconds())
+}
+
+// criticalOperationsDrained reports whether no critical operation is running and
+// CriticalDrainGrace has elapsed since the last one finished, used by both run()'s stop
+// handling and Shutdown() so they agree on when it's safe to release responsibility.
+func (h *HA) criticalOperationsDrained() bool {
+	return atomic.LoadUint64(&h.runningCriticalOperations) == 0 &&
+		h.clock.Now().Unix()-atomic.LoadInt64(&h.lastCriticalOperationEnd) >= int64(h.cfg.HA.CriticalDrainGrace.Seconds())
+}
+
+// stopCh returns the stopRequested channel run() should currently be selecting on.
+func (h *HA) stopCh() chan struct{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.stopRequested
+}
+
+// doneCh returns the done channel the current (or most recently started) Run() call will
+// close on return, so Shutdown() reads the same channel Run() just created instead of racing
+// with the reassignment at the top of Run().
+func (h *HA) doneCh() chan struct{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.done
+}
+
+// requestStop closes the current stopRequested channel exactly once, so run()'s loop can exit.
+func (h *HA) requestStop() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.stopClosed {
+		h.stopClosed = true
+		close(h.stopRequested)
+	}
+}
+
+// loadMetrics returns the collectors Run() last set up, or nil if Run() hasn't run yet.
+func (h *HA) loadMetrics() *metrics.Collectors {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.metrics
+}
+
+// checkIcinga2Liveness reacts to a change in Icinga 2's liveness: it moves readyForTakeover
+// towards notReadyForTakeover and TakeoverNoSync/TakeoverSync towards stop if we lose it, and
+// moves notReadyForTakeover back to readyForTakeover once it returns. It touches no database
+// state, so it's independently testable with a fake Clock. It reports whether it changed h's
+// responsibility, in which case run() should loop back around immediately rather than wait
+// for the next tick.
+func (h *HA) checkIcinga2Liveness(env *icingadb_connection.Environment) (changed bool) {
+	alive := h.icinga2IsAlive()
+
+	switch h.getResponsibility() {
+	case readyForTakeover:
+		if alive {
+			return false
+		}
+
+		h.logger.Warnw("Icinga 2 detected as not running, stopping.", "uuid", h.ourUUID.String(), "env", env.Name)
+		h.recordIcinga2AliveTransition()
+
+		h.setResponsibility(notReadyForTakeover)
+		h.recordResponsibility(env)
+		return true
+	case TakeoverNoSync, TakeoverSync:
+		if alive {
+			return false
+		}
+
+		h.logger.Warnw("Icinga 2 detected as not running, stopping.", "uuid", h.ourUUID.String(), "env", env.Name)
+		h.recordIcinga2AliveTransition()
+
+		h.setResponsibility(stop)
+		h.recordResponsibility(env)
+		return true
+	case notReadyForTakeover:
+		if !alive {
+			return false
+		}
+
+		h.logger.Infow("Icinga 2 detected as running again.", "uuid", h.ourUUID.String(), "env", env.Name)
+		h.recordIcinga2AliveTransition()
+
+		h.setResponsibility(readyForTakeover)
+		h.recordResponsibility(env)
+		return true
+	}
+
+	return false
+}
+
+// confirmTakeover is called once the database has confirmed we hold responsibility for env.
+// It starts the TakeoverConfirmDelay timer the first time, and once that delay has elapsed it
+// promotes us to TakeoverSync (if we aren't already). It touches no database state, so it's
+// independently testable with a fake Clock. It reports whether the confirm delay has elapsed,
+// in which case run() publishes a wakeup whether or not this call is what tipped it over.
+func (h *HA) confirmTakeover(env *icingadb_connection.Environment) (confirmed bool) {
+	if h.responsibleSince == (time.Time{}) {
+		h.responsibleSince = h.clock.Now()
+		h.setResponsibility(TakeoverNoSync)
+		h.recordResponsibility(env)
+		return false
+	}
+
+	if h.clock.Now().Sub(h.responsibleSince) < h.cfg.HA.TakeoverConfirmDelay {
+		return false
+	}
+
+	if h.setResponsibility(TakeoverSync) == TakeoverNoSync {
+		h.logger.Infow("Taking over", "env", env.Name, "lease_epoch", atomic.LoadInt64(&h.leaseEpoch))
+		h.recordResponsibility(env)
+
+		if m := h.loadMetrics(); m != nil {
+			m.TakeoversSuccessful.Inc()
+		}
+	}
+
+	return true
 }
 
 // getResponsibility gets the responsibility.
@@ -425,3 +814,28 @@ func (h *HA) getResponsibility() responsibility {
 func (h *HA) setResponsibility(r responsibility) responsibility {
 	return responsibility(atomic.SwapUint32(&h.responsibility, uint32(r)))
 }
+
+// recordResponsibility updates the responsibility gauge for env.
+func (h *HA) recordResponsibility(env *icingadb_connection.Environment) {
+	m := h.loadMetrics()
+	if m == nil {
+		return
+	}
+
+	value := 0.0
+	if h.IsResponsible() {
+		value = 1
+	}
+
+	m.Responsibility.WithLabelValues(env.Name).Set(value)
+}
+
+// recordIcinga2AliveTransition counts a detected change of Icinga 2's liveness.
+func (h *HA) recordIcinga2AliveTransition() {
+	m := h.loadMetrics()
+	if m == nil {
+		return
+	}
+
+	m.Icinga2AliveTransitions.Inc()
+}
@@ -0,0 +1,516 @@
+package icingadb_ha_lib
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"git.icinga.com/icingadb-connection"
+	"github.com/go-redis/redis"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+func testHA(clock *manualClock) *HA {
+	return &HA{
+		cfg: &Config{HA: HAConfig{
+			Tick:                 1 * time.Second,
+			Icinga2Timeout:       5 * time.Second,
+			PeerHeartbeatTimeout: 10 * time.Second,
+			TakeoverConfirmDelay: 3 * time.Second,
+			CriticalDrainGrace:   2 * time.Second,
+		}},
+		logger: zap.NewNop().Sugar(),
+		clock:  clock,
+	}
+}
+
+// fakeInstanceRow mirrors a row of icingadb_instance.
+type fakeInstanceRow struct {
+	environmentID  string
+	heartbeat      int64
+	responsible    string
+	leaseEpoch     int64
+	leaseExpiresAt int64
+}
+
+// fakeDBWrapper is a dbWrapper backed by an in-memory icingadb_instance table, so tests can
+// drive run()'s tryTakeover/doTakeover/ceaseOperation state machine, including the lease-epoch
+// bookkeeping, without a real database. It never looks at the *sql.Tx it's handed: ha.go only
+// ever threads that value through to further dbWrapper calls, never to the stdlib sql package
+// directly, so SqlTransaction(Quiet) simply runs f(nil) while holding mu for the duration.
+type fakeDBWrapper struct {
+	mu   sync.Mutex
+	rows map[string]*fakeInstanceRow
+}
+
+func newFakeDBWrapper() *fakeDBWrapper {
+	return &fakeDBWrapper{rows: make(map[string]*fakeInstanceRow)}
+}
+
+// fakeResult is a minimal sql.Result for fakeDBWrapper's Sql*Exec* methods.
+type fakeResult int64
+
+func (r fakeResult) LastInsertId() (int64, error) { return 0, nil }
+func (r fakeResult) RowsAffected() (int64, error) { return int64(r), nil }
+
+// asInt64 accepts either int or int64, since ha.go passes some SqlExecQuiet args as untyped int
+// constants (e.g. the literal 0 lease_epoch/lease_expires_at on first insert) that a real
+// database/sql driver coerces but a fake args[i].(int64) assertion would otherwise panic on.
+func asInt64(v interface{}) int64 {
+	switch n := v.(type) {
+	case int64:
+		return n
+	case int:
+		return int64(n)
+	default:
+		panic(fmt.Sprintf("asInt64: unexpected type %T", v))
+	}
+}
+
+func (f *fakeDBWrapper) SqlTransaction(_, _ bool, fn func(tx *sql.Tx) error) error {
+	return f.SqlTransactionQuiet(false, false, fn)
+}
+
+func (f *fakeDBWrapper) SqlTransactionQuiet(_, _ bool, fn func(tx *sql.Tx) error) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return fn(nil)
+}
+
+func (f *fakeDBWrapper) SqlExec(_ *sql.Tx, label, _ string, args ...interface{}) (sql.Result, error) {
+	switch label {
+	case "update icingadb_instance by id":
+		// Shutdown() handing responsibility back.
+		row, ok := f.rows[string(args[1].([]byte))]
+		if !ok {
+			return fakeResult(0), nil
+		}
+
+		row.responsible = args[0].(string)
+		return fakeResult(1), nil
+	case "delete from icingadb_instance by heartbeat":
+		now, age := args[0].(int64), args[1].(int64)
+		var affected int64
+		for id, row := range f.rows {
+			if now-row.heartbeat >= age {
+				delete(f.rows, id)
+				affected++
+			}
+		}
+		return fakeResult(affected), nil
+	default:
+		panic("fakeDBWrapper: unexpected SqlExec label " + label)
+	}
+}
+
+func (f *fakeDBWrapper) SqlExecQuiet(_ *sql.Tx, label, _ string, args ...interface{}) (sql.Result, error) {
+	switch label {
+	case "update icingadb_instance by id":
+		row := f.rows[string(args[2].([]byte))]
+		row.environmentID = args[0].(string)
+		row.heartbeat = args[1].(int64)
+		return fakeResult(1), nil
+	case "insert into icingadb_instance":
+		f.rows[string(args[0].([]byte))] = &fakeInstanceRow{
+			environmentID:  args[1].(string),
+			heartbeat:      args[2].(int64),
+			responsible:    args[3].(string),
+			leaseEpoch:     asInt64(args[4]),
+			leaseExpiresAt: asInt64(args[5]),
+		}
+		return fakeResult(1), nil
+	case "renew icingadb_instance lease by id, lease_epoch":
+		expiresAt, id, epoch := args[0].(int64), args[1].([]byte), args[2].(int64)
+		row, ok := f.rows[string(id)]
+		if !ok || row.leaseEpoch != epoch {
+			return fakeResult(0), nil
+		}
+
+		row.leaseExpiresAt = expiresAt
+		return fakeResult(1), nil
+	case "take over icingadb_instance lease by id":
+		responsible, epoch, expiresAt, id := args[0].(string), args[1].(int64), args[2].(int64), args[3].([]byte)
+		row, ok := f.rows[string(id)]
+		if !ok {
+			return fakeResult(0), nil
+		}
+
+		row.responsible, row.leaseEpoch, row.leaseExpiresAt = responsible, epoch, expiresAt
+		return fakeResult(1), nil
+	case "update icingadb_instance":
+		responsible, expiresAt, id := args[0].(string), asInt64(args[1]), args[2].([]byte)
+		row, ok := f.rows[string(id)]
+		if !ok {
+			return fakeResult(0), nil
+		}
+
+		row.responsible, row.leaseExpiresAt = responsible, expiresAt
+		return fakeResult(1), nil
+	default:
+		panic("fakeDBWrapper: unexpected SqlExecQuiet label " + label)
+	}
+}
+
+func (f *fakeDBWrapper) SqlFetchAllQuiet(_ *sql.Tx, label, _ string, args ...interface{}) ([][]interface{}, error) {
+	switch label {
+	case "select from icingadb_instance by id":
+		if _, ok := f.rows[string(args[0].([]byte))]; ok {
+			return [][]interface{}{{int64(1)}}, nil
+		}
+		return nil, nil
+	case "select from icingadb_instance by environment_id for update":
+		environmentID := args[0].(string)
+		var out [][]interface{}
+		for id, row := range f.rows {
+			if row.environmentID == environmentID {
+				out = append(out, []interface{}{[]byte(id), row.responsible, row.leaseEpoch, row.leaseExpiresAt})
+			}
+		}
+		return out, nil
+	case "select from icingadb_instance by environment_id, responsible, heartbeat":
+		environmentID, responsible, now, timeout := args[0].(string), args[1].(string), args[2].(int64), args[3].(int64)
+		for _, row := range f.rows {
+			if row.environmentID == environmentID && row.responsible == responsible && now-row.heartbeat < timeout {
+				return [][]interface{}{{int64(1)}}, nil
+			}
+		}
+		return nil, nil
+	default:
+		panic("fakeDBWrapper: unexpected SqlFetchAllQuiet label " + label)
+	}
+}
+
+// testEnv returns an Environment and a *redis.Client pointed at a loopback address that's
+// never actually dialed: the scenarios below never drive run() far enough past a takeover for
+// it to reach the rdb.Publish wakeup call (that requires TakeoverConfirmDelay to have elapsed,
+// which confirmTakeover already covers on its own in TestConfirmTakeover).
+func testEnv() (*icingadb_connection.Environment, *redis.Client) {
+	return &icingadb_connection.Environment{ID: "env-1", Name: "test"},
+		redis.NewClient(&redis.Options{Addr: "127.0.0.1:0"})
+}
+
+func TestRunTakesOverLeaseWhenNoPeerIsResponsible(t *testing.T) {
+	clock := newManualClock(time.Unix(1700000000, 0))
+	h := testHA(clock)
+	env, rdb := testEnv()
+	db := newFakeDBWrapper()
+
+	chEnv := make(chan *icingadb_connection.Environment, 1)
+	chEnv <- env
+	close(chEnv)
+
+	if err := h.run(context.Background(), rdb, db, chEnv); err != nil {
+		t.Fatalf("run returned %v, want nil", err)
+	}
+
+	if got := h.getResponsibility(); got != TakeoverNoSync {
+		t.Fatalf("responsibility = %v, want TakeoverNoSync", got)
+	}
+	if got := h.LeaseEpoch(); got != 1 {
+		t.Fatalf("LeaseEpoch() = %d, want 1", got)
+	}
+
+	row := db.rows[string(h.ourUUID[:])]
+	if row == nil || row.responsible != "y" {
+		t.Fatalf("icingadb_instance row = %+v, want responsible=y", row)
+	}
+}
+
+func TestRunDoesNotTakeOverFromALiveLeader(t *testing.T) {
+	clock := newManualClock(time.Unix(1700000000, 0))
+	h := testHA(clock)
+	env, rdb := testEnv()
+	db := newFakeDBWrapper()
+	db.rows["other"] = &fakeInstanceRow{
+		environmentID:  env.ID,
+		heartbeat:      clock.Now().Unix(),
+		responsible:    "y",
+		leaseEpoch:     1,
+		leaseExpiresAt: clock.Now().Unix() + int64(h.cfg.HA.PeerHeartbeatTimeout.Seconds()),
+	}
+
+	chEnv := make(chan *icingadb_connection.Environment, 1)
+	chEnv <- env
+	close(chEnv)
+
+	if err := h.run(context.Background(), rdb, db, chEnv); err != nil {
+		t.Fatalf("run returned %v, want nil", err)
+	}
+
+	if got := h.getResponsibility(); got != readyForTakeover {
+		t.Fatalf("responsibility = %v, want readyForTakeover", got)
+	}
+	if got := h.LeaseEpoch(); got != 0 {
+		t.Fatalf("LeaseEpoch() = %d, want 0", got)
+	}
+}
+
+func TestRunCeasesOperationWhenIcinga2GoesOffline(t *testing.T) {
+	clock := newManualClock(time.Unix(1700000000, 0))
+	h := testHA(clock)
+	env, rdb := testEnv()
+	db := newFakeDBWrapper()
+
+	chEnv := make(chan *icingadb_connection.Environment, 1)
+	chEnv <- env
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() { done <- h.run(ctx, rdb, db, chEnv) }()
+
+	waitFor(t, "lease taken over", func() bool { return h.LeaseEpoch() == 1 })
+
+	// Let Icinga 2's heartbeat go stale: the next tick should drop us to stop and, since
+	// nobody else is around to hand responsibility to, straight on to notReadyForTakeover.
+	clock.Advance(h.cfg.HA.Icinga2Timeout)
+	clock.Tick()
+	waitFor(t, "ceased operation", func() bool { return h.getResponsibility() == notReadyForTakeover })
+
+	cancel()
+
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("run returned %v, want context.Canceled", err)
+	}
+	if got := h.LeaseEpoch(); got != 0 {
+		t.Fatalf("LeaseEpoch() = %d, want 0 after ceasing operation", got)
+	}
+}
+
+func TestShutdownDrainsAndHandsResponsibilityBack(t *testing.T) {
+	clock := newManualClock(time.Unix(1700000000, 0))
+	h := testHA(clock)
+	env, rdb := testEnv()
+	db := newFakeDBWrapper()
+	reg := prometheus.NewRegistry()
+
+	chEnv := make(chan *icingadb_connection.Environment, 1)
+	chEnv <- env
+	chErr := make(chan error, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	runDone := make(chan struct{})
+	go func() {
+		h.Run(ctx, rdb, db, chEnv, chErr, reg)
+		close(runDone)
+	}()
+
+	waitFor(t, "lease taken over", func() bool { return h.LeaseEpoch() == 1 })
+
+	if err := h.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown returned %v, want nil", err)
+	}
+
+	select {
+	case <-runDone:
+	case <-time.After(time.Second):
+		t.Fatalf("Run did not return after Shutdown")
+	}
+
+	row := db.rows[string(h.ourUUID[:])]
+	if row == nil || row.responsible != "n" {
+		t.Fatalf("icingadb_instance row = %+v, want responsible=n after Shutdown", row)
+	}
+
+	select {
+	case err := <-chErr:
+		t.Fatalf("Run reported error %v, want none", err)
+	default:
+	}
+
+	ran := false
+	err := h.RunCriticalOperation(context.Background(), func(epoch int64) error {
+		ran = true
+		return nil
+	})
+	if ran || err != nil {
+		t.Fatalf("RunCriticalOperation after Shutdown: ran=%v err=%v, want ran=false err=nil", ran, err)
+	}
+	if got := h.LeaseEpoch(); got != 0 {
+		t.Fatalf("LeaseEpoch() = %d, want 0 after Shutdown", got)
+	}
+}
+
+func TestRunSkipsMetricsServerWhenAlreadyBound(t *testing.T) {
+	clock := newManualClock(time.Unix(1700000000, 0))
+	h := testHA(clock)
+	h.cfg.Metrics = MetricsConfig{Enabled: true, Host: "not-a-real-host", Port: 1}
+	h.metricsServing = true // a metrics server from a previous Run() call is still bound.
+
+	env, rdb := testEnv()
+	db := newFakeDBWrapper()
+	reg := prometheus.NewRegistry()
+
+	chEnv := make(chan *icingadb_connection.Environment, 1)
+	chEnv <- env
+	chErr := make(chan error, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	runDone := make(chan struct{})
+	go func() {
+		h.Run(ctx, rdb, db, chEnv, chErr, reg)
+		close(runDone)
+	}()
+
+	waitFor(t, "lease taken over", func() bool { return h.LeaseEpoch() == 1 })
+
+	if err := h.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown returned %v, want nil", err)
+	}
+
+	select {
+	case <-runDone:
+	case <-time.After(time.Second):
+		t.Fatalf("Run did not return after Shutdown")
+	}
+
+	select {
+	case err := <-chErr:
+		// "not-a-real-host" would fail to resolve the moment ServeHTTP tried to listen on it,
+		// so an error here means Run started a second server instead of skipping it.
+		t.Fatalf("Run reported error %v, want none (metrics server should not have been (re)started)", err)
+	default:
+	}
+
+	if !h.metricsServing {
+		t.Fatalf("metricsServing = false, want true (still owned by the simulated earlier server)")
+	}
+}
+
+// waitFor polls cond until it's true, failing the test if it doesn't happen soon: run()'s loop
+// reacts to manualClock.Tick() on its own goroutine, so tests driving it need to wait rather
+// than assert immediately.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	for i := 0; i < 1000; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	t.Fatalf("timed out waiting for: %s", what)
+}
+
+func TestCheckIcinga2LivenessLoseAndRegain(t *testing.T) {
+	clock := newManualClock(time.Unix(1700000000, 0))
+	h := testHA(clock)
+	env := &icingadb_connection.Environment{Name: "test"}
+
+	h.setResponsibility(readyForTakeover)
+	h.Icinga2HeartBeat()
+
+	if changed := h.checkIcinga2Liveness(env); changed {
+		t.Fatalf("liveness reported changed while Icinga 2 heartbeat is fresh")
+	}
+	if got := h.getResponsibility(); got != readyForTakeover {
+		t.Fatalf("responsibility = %v, want readyForTakeover", got)
+	}
+
+	// Lose Icinga 2: advance past Icinga2Timeout without another heartbeat.
+	clock.Advance(h.cfg.HA.Icinga2Timeout)
+
+	if changed := h.checkIcinga2Liveness(env); !changed {
+		t.Fatalf("liveness reported unchanged after Icinga 2 timeout elapsed")
+	}
+	if got := h.getResponsibility(); got != notReadyForTakeover {
+		t.Fatalf("responsibility = %v, want notReadyForTakeover", got)
+	}
+
+	// Regain Icinga 2.
+	h.Icinga2HeartBeat()
+
+	if changed := h.checkIcinga2Liveness(env); !changed {
+		t.Fatalf("liveness reported unchanged on regaining Icinga 2")
+	}
+	if got := h.getResponsibility(); got != readyForTakeover {
+		t.Fatalf("responsibility = %v, want readyForTakeover", got)
+	}
+}
+
+func TestCheckIcinga2LivenessDropsResponsibleInstanceToStop(t *testing.T) {
+	clock := newManualClock(time.Unix(1700000000, 0))
+	h := testHA(clock)
+	env := &icingadb_connection.Environment{Name: "test"}
+
+	h.setResponsibility(TakeoverSync)
+	h.Icinga2HeartBeat()
+
+	clock.Advance(h.cfg.HA.Icinga2Timeout)
+
+	if changed := h.checkIcinga2Liveness(env); !changed {
+		t.Fatalf("liveness reported unchanged after Icinga 2 timeout elapsed")
+	}
+	if got := h.getResponsibility(); got != stop {
+		t.Fatalf("responsibility = %v, want stop", got)
+	}
+}
+
+func TestConfirmTakeover(t *testing.T) {
+	clock := newManualClock(time.Unix(1700000000, 0))
+	h := testHA(clock)
+	env := &icingadb_connection.Environment{Name: "test"}
+
+	if confirmed := h.confirmTakeover(env); confirmed {
+		t.Fatalf("confirmTakeover reported confirmed on the very first call")
+	}
+	if got := h.getResponsibility(); got != TakeoverNoSync {
+		t.Fatalf("responsibility = %v, want TakeoverNoSync", got)
+	}
+
+	// Not enough time has passed yet.
+	clock.Advance(h.cfg.HA.TakeoverConfirmDelay - time.Millisecond)
+	if confirmed := h.confirmTakeover(env); confirmed {
+		t.Fatalf("confirmTakeover reported confirmed before TakeoverConfirmDelay elapsed")
+	}
+	if got := h.getResponsibility(); got != TakeoverNoSync {
+		t.Fatalf("responsibility = %v, want TakeoverNoSync", got)
+	}
+
+	// Now it has.
+	clock.Advance(time.Millisecond)
+	if confirmed := h.confirmTakeover(env); !confirmed {
+		t.Fatalf("confirmTakeover reported unconfirmed after TakeoverConfirmDelay elapsed")
+	}
+	if got := h.getResponsibility(); got != TakeoverSync {
+		t.Fatalf("responsibility = %v, want TakeoverSync", got)
+	}
+}
+
+func TestRunCriticalOperationFencing(t *testing.T) {
+	clock := newManualClock(time.Unix(1700000000, 0))
+	h := testHA(clock)
+
+	h.setResponsibility(TakeoverSync)
+	h.leaseEpoch = 1
+
+	if err := h.RunCriticalOperation(context.Background(), func(epoch int64) error {
+		if epoch != 1 {
+			t.Fatalf("op called with epoch %d, want 1", epoch)
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("RunCriticalOperation returned %v, want nil", err)
+	}
+
+	// Another instance takes over mid-operation: fence us out.
+	err := h.RunCriticalOperation(context.Background(), func(epoch int64) error {
+		h.leaseEpoch = 2
+		return nil
+	})
+	if !errors.Is(err, ErrLeaseFenced) {
+		t.Fatalf("RunCriticalOperation returned %v, want ErrLeaseFenced", err)
+	}
+}
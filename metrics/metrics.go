@@ -0,0 +1,110 @@
+// Package metrics provides the Prometheus collectors icingadb_ha_lib exposes
+// and a small opt-in HTTP server to scrape them from.
+package metrics
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Collectors bundles the Prometheus collectors HA reports through.
+type Collectors struct {
+	// Responsibility is 1 if this instance is responsible for environment, 0 otherwise.
+	Responsibility *prometheus.GaugeVec
+	// TakeoverAttempts counts every attempted takeover, successful or not.
+	TakeoverAttempts prometheus.Counter
+	// TakeoversSuccessful counts takeovers that actually made us responsible.
+	TakeoversSuccessful prometheus.Counter
+	// CeaseOperations counts how often we ceased operations and dropped our responsibility,
+	// whether or not another instance was there to take it over.
+	CeaseOperations prometheus.Counter
+	// Icinga2AliveTransitions counts every time Icinga 2 was detected as having started or stopped.
+	Icinga2AliveTransitions prometheus.Counter
+	// CriticalOperationDuration observes how long critical operations take while responsible.
+	CriticalOperationDuration prometheus.Histogram
+	// RunningCriticalOperations is the number of critical operations currently running.
+	RunningCriticalOperations prometheus.Gauge
+}
+
+// NewCollectors creates HA's collectors and registers them on reg.
+func NewCollectors(reg *prometheus.Registry) *Collectors {
+	c := &Collectors{
+		Responsibility: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "icingadb",
+			Subsystem: "ha",
+			Name:      "responsible",
+			Help:      "Whether this instance is responsible for its environment (1) or not (0).",
+		}, []string{"environment"}),
+		TakeoverAttempts: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "icingadb",
+			Subsystem: "ha",
+			Name:      "takeover_attempts_total",
+			Help:      "Total number of takeover attempts.",
+		}),
+		TakeoversSuccessful: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "icingadb",
+			Subsystem: "ha",
+			Name:      "takeovers_successful_total",
+			Help:      "Total number of takeovers that made us responsible.",
+		}),
+		CeaseOperations: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "icingadb",
+			Subsystem: "ha",
+			Name:      "cease_operations_total",
+			Help:      "Total number of times this instance ceased operations and dropped its responsibility.",
+		}),
+		Icinga2AliveTransitions: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "icingadb",
+			Subsystem: "ha",
+			Name:      "icinga2_alive_transitions_total",
+			Help:      "Total number of times Icinga 2 was detected as having started or stopped.",
+		}),
+		CriticalOperationDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "icingadb",
+			Subsystem: "ha",
+			Name:      "critical_operation_duration_seconds",
+			Help:      "Duration of critical operations run while responsible.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+		RunningCriticalOperations: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "icingadb",
+			Subsystem: "ha",
+			Name:      "running_critical_operations",
+			Help:      "Number of critical operations currently running.",
+		}),
+	}
+
+	reg.MustRegister(
+		c.Responsibility,
+		c.TakeoverAttempts,
+		c.TakeoversSuccessful,
+		c.CeaseOperations,
+		c.Icinga2AliveTransitions,
+		c.CriticalOperationDuration,
+		c.RunningCriticalOperations,
+	)
+
+	return c
+}
+
+// ServeHTTP exposes reg on addr at /metrics until ctx is cancelled.
+func ServeHTTP(ctx context.Context, addr string, reg *prometheus.Registry) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+
+	srv := &http.Server{Addr: addr, Handler: mux}
+
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	if errListen := srv.ListenAndServe(); errListen != nil && errListen != http.ErrServerClosed {
+		return errListen
+	}
+
+	return nil
+}